@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ports/", handleAdminPort)
+	mux.HandleFunc("/stats", handleAdminStats)
+
+	log.Printf("Serving admin API on %s\n", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Can't serve admin API: %s\n", err)
+	}
+}
+
+// handleAdminPort serves /ports/<port>/<action>
+func handleAdminPort(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ports/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	p, ok := redisPorts[parts[0]]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown port %s", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "nodes":
+		handleAdminNodes(w, r, p)
+	case "status", "enable", "disable":
+		handleAdminState(w, r, p, parts[1])
+	case "drill":
+		handleAdminDrill(w, r, p)
+	case "stale":
+		handleAdminStale(w, r, p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAdminNodes lists (GET), adds (POST) or removes (DELETE) the node
+// given in the "node" query parameter; with "persist=1" the resulting
+// list is also saved to the config file
+func handleAdminNodes(w http.ResponseWriter, r *http.Request, p *RedisPort) {
+	node := r.URL.Query().Get("node")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		if node == "" {
+			http.Error(w, "node parameter is required", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method != http.MethodGet && p.discoverer != nil {
+		http.Error(w, fmt.Sprintf("nodes of port %s are managed by discovery", p.port), http.StatusConflict)
+		return
+	}
+
+	p.mutex.Lock()
+
+	idx := -1
+	for i, n := range p.nodes {
+		if n == node {
+			idx = i
+			break
+		}
+	}
+
+	var nodes []string
+	var status int
+
+	switch {
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodPost && idx >= 0:
+		status = http.StatusConflict
+	case r.Method == http.MethodPost:
+		nodes = append(append(nodes, p.nodes...), node)
+	case idx < 0:
+		status = http.StatusNotFound
+	case len(p.nodes) == 1:
+		status = http.StatusBadRequest
+	default:
+		nodes = append(append(nodes, p.nodes[:idx]...), p.nodes[idx+1:]...)
+	}
+
+	// the slice is replaced, not modified, as probes may be iterating over the old one
+	if nodes != nil {
+		p.nodes = nodes
+	}
+
+	nodes = p.nodes
+
+	p.mutex.Unlock()
+
+	switch status {
+	case http.StatusConflict:
+		http.Error(w, fmt.Sprintf("node %s is already in the list", node), status)
+		return
+	case http.StatusNotFound:
+		http.Error(w, fmt.Sprintf("node %s is not in the list", node), status)
+		return
+	case http.StatusBadRequest:
+		http.Error(w, "can't remove the last node", status)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		action := "Added node %s to port %s"
+		if r.Method == http.MethodDelete {
+			action = "Removed node %s from port %s"
+		}
+
+		log.Printf("Admin API: "+action+"\n", node, p.port)
+
+		if r.URL.Query().Get("persist") == "1" {
+			if err := persistNodes(p); err != nil {
+				log.Printf("Can't save config file: %s\n", err)
+				http.Error(w, fmt.Sprintf("node list changed, but not saved: %s", err), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	writeJSON(w, nodes)
+}
+
+type runtimeStats struct {
+	Goroutines    int     `json:"goroutines"`
+	HeapInUse     uint64  `json:"heap_inuse_bytes"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	SysMemory     uint64  `json:"sys_bytes"`
+	NumGC         uint32  `json:"gc_count"`
+	LastGCPause   float64 `json:"gc_last_pause_ms"`
+	TotalGCPause  float64 `json:"gc_total_pause_ms"`
+	OpenFDs       int     `json:"open_fds"` // -1 if unknown
+	UptimeSeconds int64   `json:"uptime_seconds"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+}
+
+type nodeStatsOutput struct {
+	State        string `json:"state"`
+	AuthFailures uint64 `json:"auth_failures"`
+}
+
+type statsOutput struct {
+	ActiveConnections  uint32                     `json:"active_connections"`
+	ConnectionsProxied uint64                     `json:"connections_proxied"`
+	AuthFailures       uint64                     `json:"auth_failures"`
+	NonRESPRejected    uint64                     `json:"non_resp_rejected"`
+	ConnectionsShed    uint64                     `json:"connections_shed"`
+	ReplStalls         uint64                     `json:"repl_stalls"`
+	StaleConnections   int                        `json:"stale_connections"`
+	BufferedBytes      int64                      `json:"buffered_bytes_estimate"`
+	Nodes              map[string]nodeStatsOutput `json:"nodes"`
+	Runtime            runtimeStats               `json:"runtime"`
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	out := statsOutput{
+		ActiveConnections:  atomic.LoadUint32(&globalStats.pipesActive) / 2,
+		ConnectionsProxied: atomic.LoadUint64(&globalStats.connectionsProxied),
+		AuthFailures:       atomic.LoadUint64(&globalStats.authFailures),
+		NonRESPRejected:    atomic.LoadUint64(&globalStats.nonRESPRejected),
+		ConnectionsShed:    atomic.LoadUint64(&globalStats.connectionsShed),
+		ReplStalls:         atomic.LoadUint64(&globalStats.replStalls),
+		BufferedBytes:      atomic.LoadInt64(&globalStats.bufferedBytes),
+		Nodes:              map[string]nodeStatsOutput{},
+		Runtime:            getRuntimeStats(),
+	}
+
+	for _, p := range redisPorts {
+		out.StaleConnections += len(p.staleSessions())
+	}
+
+	nodeStats.Range(func(key, value interface{}) bool {
+		ns := value.(*NodeStats)
+		out.Nodes[key.(string)] = nodeStatsOutput{
+			State:        ns.getState(),
+			AuthFailures: atomic.LoadUint64(&ns.authFailures),
+		}
+		return true
+	})
+
+	writeJSON(w, out)
+}
+
+func getRuntimeStats() runtimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	rs := runtimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapInUse:     ms.HeapInuse,
+		HeapObjects:   ms.HeapObjects,
+		SysMemory:     ms.Sys,
+		NumGC:         ms.NumGC,
+		TotalGCPause:  float64(ms.PauseTotalNs) / 1e6,
+		OpenFDs:       -1,
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+	}
+
+	if ms.NumGC > 0 {
+		rs.LastGCPause = float64(ms.PauseNs[(ms.NumGC+255)%256]) / 1e6
+	}
+
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		rs.OpenFDs = len(fds)
+	}
+
+	return rs
+}
+
+type portState struct {
+	Port      string `json:"port"`
+	Enabled   bool   `json:"enabled"`
+	Listening bool   `json:"listening"`
+	Master    string `json:"master"`
+
+	MasterStalled bool `json:"master_stalled"` // see repl_stall_cycles
+}
+
+// handleAdminState shows (GET .../status) or changes (POST .../enable,
+// POST .../disable[?close_listener=1]) whether the port accepts new clients
+func handleAdminState(w http.ResponseWriter, r *http.Request, p *RedisPort, action string) {
+	if action == "status" && r.Method != http.MethodGet || action != "status" && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "enable":
+		if err := enablePort(p); err != nil {
+			log.Printf("Can't reopen listening socket for port %s: %s\n", p.port, err)
+			http.Error(w, fmt.Sprintf("can't reopen listening socket: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Admin API: Enabled port %s\n", p.port)
+	case "disable":
+		closeListener := r.URL.Query().Get("close_listener") == "1"
+		disablePort(p, closeListener)
+
+		if closeListener {
+			log.Printf("Admin API: Disabled port %s and closed its listener\n", p.port)
+		} else {
+			log.Printf("Admin API: Disabled port %s\n", p.port)
+		}
+	}
+
+	p.mutex.RLock()
+	state := portState{
+		Port:      p.port,
+		Enabled:   !p.disabled,
+		Listening: p.listener != nil,
+		Master:    p.master,
+
+		MasterStalled: p.masterStalled,
+	}
+	p.mutex.RUnlock()
+
+	writeJSON(w, state)
+}
+
+type drillState struct {
+	Port    string    `json:"port"`
+	Ignored string    `json:"ignored_master"`
+	Until   time.Time `json:"until"`
+}
+
+// handleAdminDrill starts a failover drill (POST .../drill?seconds=N, 30 seconds by default)
+func handleAdminDrill(w http.ResponseWriter, r *http.Request, p *RedisPort) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seconds := 30
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		var err error
+		if seconds, err = strconv.Atoi(v); err != nil || seconds < 1 {
+			http.Error(w, "seconds must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	master, until, err := startDrill(p, time.Duration(seconds)*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, drillState{Port: p.port, Ignored: master, Until: until})
+}
+
+type staleOutput struct {
+	Port        string         `json:"port"`
+	Master      string         `json:"master"`
+	Connections int            `json:"connections"`
+	Clients     map[string]int `json:"clients"` // client IP -> number of connections
+	Masters     map[string]int `json:"masters"` // stale master -> number of connections
+}
+
+// handleAdminStale shows the connections still attached to a master other than the current one
+func handleAdminStale(w http.ResponseWriter, r *http.Request, p *RedisPort) {
+	stale := p.staleSessions()
+
+	out := staleOutput{
+		Port:        p.port,
+		Connections: len(stale),
+		Clients:     map[string]int{},
+		Masters:     map[string]int{},
+	}
+
+	p.mutex.RLock()
+	out.Master = p.lastMaster
+	p.mutex.RUnlock()
+
+	for _, s := range stale {
+		out.Clients[s.clientIP()]++
+		out.Masters[s.master]++
+	}
+
+	writeJSON(w, out)
+}
+
+// persistNodes stores the port's node list in the config file,
+// which is rewritten as a whole (so comments are not preserved)
+func persistNodes(p *RedisPort) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	// taken under configMutex, so that concurrent changes are saved in order
+	p.mutex.RLock()
+	nodes := p.nodes
+	p.mutex.RUnlock()
+
+	for i := range config.Ports {
+		if config.Ports[i].Port == p.port {
+			config.Ports[i].Nodes = nodes
+		}
+	}
+
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	// only the port's entry is changed, other options are kept as written
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	for _, item := range doc {
+		if entries, ok := item.Value.([]interface{}); ok && item.Key == "ports" {
+			for i := range entries {
+				entries[i] = setPortNodes(entries[i], p.port, nodes)
+			}
+		}
+	}
+
+	b, err = yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), filepath.Base(configFile)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(configFile); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+
+	return os.Rename(tmp.Name(), configFile)
+}
+
+// setPortNodes sets nodes in the ports list entry if it's for the given port,
+// turning a bare port number into a mapping if needed
+func setPortNodes(entry interface{}, port string, nodes []string) interface{} {
+	m, ok := entry.(yaml.MapSlice)
+	if !ok {
+		if fmt.Sprint(entry) != port {
+			return entry
+		}
+
+		return yaml.MapSlice{{Key: "port", Value: entry}, {Key: "nodes", Value: nodes}}
+	}
+
+	matches := false
+	for _, item := range m {
+		if item.Key == "port" {
+			matches = fmt.Sprint(item.Value) == port
+		}
+	}
+
+	if !matches {
+		return entry
+	}
+
+	for i := range m {
+		if m[i].Key == "nodes" {
+			m[i].Value = nodes
+			return m
+		}
+	}
+
+	return append(m, yaml.MapItem{Key: "nodes", Value: nodes})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersistNodes(t *testing.T) {
+	defer func(c ConfigStruct, fn string) { config, configFile = c, fn }(config, configFile)
+
+	tests := []struct {
+		name  string
+		in    string
+		port  string
+		nodes []string
+		want  string
+	}{
+		{
+			name:  "bare port becomes mapping",
+			in:    "ports:\n- 6379\n- 6380\nnodes:\n- redis1\ndial_stagger_ms: 100\n",
+			port:  "6379",
+			nodes: []string{"redis1", "redis2"},
+			want:  "ports:\n- port: 6379\n  nodes:\n  - redis1\n  - redis2\n- 6380\nnodes:\n- redis1\ndial_stagger_ms: 100\n",
+		},
+		{
+			name:  "quoted bare port",
+			in:    "ports:\n- \"6379\"\n",
+			port:  "6379",
+			nodes: []string{"redis1"},
+			want:  "ports:\n- port: \"6379\"\n  nodes:\n  - redis1\n",
+		},
+		{
+			name:  "existing nodes replaced",
+			in:    "ports:\n- 6379\n- port: 6380\n  listen: 192.0.2.10\n  nodes:\n  - redis3\n  network: tcp4\nauth: secret\n",
+			port:  "6380",
+			nodes: []string{"redis3", "redis4:6390"},
+			want:  "ports:\n- 6379\n- port: 6380\n  listen: 192.0.2.10\n  nodes:\n  - redis3\n  - redis4:6390\n  network: tcp4\nauth: secret\n",
+		},
+		{
+			name:  "nodes added to mapping",
+			in:    "ports:\n- port: 6380\n  listen: 192.0.2.10\n- port: 6381\n  listen: 192.0.2.11\n",
+			port:  "6381",
+			nodes: []string{"redis5"},
+			want:  "ports:\n- port: 6380\n  listen: 192.0.2.10\n- port: 6381\n  listen: 192.0.2.11\n  nodes:\n  - redis5\n",
+		},
+		{
+			name:  "other port left alone",
+			in:    "ports:\n- 6379\n- port: 6380\n  nodes:\n  - redis3\nproxy_connection_timeout: 3\n",
+			port:  "6381",
+			nodes: []string{"redis5"},
+			want:  "ports:\n- 6379\n- port: 6380\n  nodes:\n  - redis3\nproxy_connection_timeout: 3\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile = filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.in), 0o640); err != nil {
+				t.Fatal(err)
+			}
+
+			config = ConfigStruct{Ports: []PortConfig{{Port: tt.port}}}
+
+			if err := persistNodes(&RedisPort{port: tt.port, nodes: tt.nodes}); err != nil {
+				t.Fatalf("persistNodes() error = %v", err)
+			}
+
+			b, err := os.ReadFile(configFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != tt.want {
+				t.Errorf("config file is\n%s\nwant\n%s", b, tt.want)
+			}
+
+			if fi, err := os.Stat(configFile); err != nil || fi.Mode().Perm() != 0o640 {
+				t.Errorf("config file mode changed: %v, %v", fi.Mode(), err)
+			}
+
+			if got := config.Ports[0].Nodes; len(got) != len(tt.nodes) {
+				t.Errorf("config.Ports[0].Nodes = %v, want %v", got, tt.nodes)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// upstreamDialer, when set (SOCKS5 proxy or SSH tunnel), is used for all
+// connections to Redis nodes instead of connecting to them directly
+var upstreamDialer netproxy.ContextDialer
+
+func setupUpstreamProxy(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return fmt.Errorf("unsupported proxy scheme %q, expected socks5", u.Scheme)
+	}
+
+	d, err := netproxy.FromURL(u, netproxy.Direct)
+	if err != nil {
+		return err
+	}
+
+	cd, ok := d.(netproxy.ContextDialer)
+	if !ok {
+		return fmt.Errorf("proxy dialer doesn't support contexts")
+	}
+
+	upstreamDialer = cd
+
+	return nil
+}
+
+// dialBackend connects to a Redis node, returning the connection and the address
+// to be used by dialBackendAddr to reach the same node later
+func dialBackend(ctx context.Context, host, port string) (net.Conn, string, error) {
+	if upstreamDialer != nil {
+		// let the proxy or tunnel resolve the name, the node may be unresolvable from here
+		addr := net.JoinHostPort(host, port)
+		conn, err := upstreamDialer.DialContext(ctx, "tcp", addr)
+		return conn, addr, err
+	}
+
+	conn, err := dialHappyEyeballs(ctx, host, port)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return conn, conn.RemoteAddr().String(), nil
+}
+
+func dialBackendAddr(ctx context.Context, addr string) (net.Conn, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return dialBackend(ctx, host, port)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs connects to host:port trying all of its addresses in parallel,
+// each next one started dial_stagger_ms after the previous (RFC 8305 style),
+// so a broken address family doesn't stall the whole dial until timeout
+func dialHappyEyeballs(ctx context.Context, host, port string) (net.Conn, error) {
+	ips, err := lookupIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no addresses found", Addr: host}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	stagger := time.Duration(config.DialStagger) * time.Millisecond
+
+	for i, ip := range ips {
+		go func(delay time.Duration, addr string) {
+			if delay > 0 {
+				t := time.NewTimer(delay)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					results <- dialResult{err: ctx.Err()}
+					return
+				}
+			}
+
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- dialResult{conn, err}
+		}(time.Duration(i)*stagger, net.JoinHostPort(ip.String(), port))
+	}
+
+	var firstErr error
+	for i := 0; i < len(ips); i++ {
+		res := <-results
+		if res.err == nil {
+			cancel()
+
+			// close the connections that won't be used
+			go func(left int) {
+				for ; left > 0; left-- {
+					if res := <-results; res.conn != nil {
+						res.conn.Close()
+					}
+				}
+			}(len(ips) - i - 1)
+
+			return res.conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// lookupIPs resolves host and interleaves address families,
+// starting with the family of the first returned address
+func lookupIPs(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return interleaveFamilies(addrs), nil
+}
+
+// interleaveFamilies orders addresses as IPv4, IPv6, IPv4... or vice versa,
+// depending on the family of the first address
+func interleaveFamilies(addrs []net.IPAddr) []net.IP {
+	var first, second []net.IP
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == (addrs[0].IP.To4() != nil) {
+			first = append(first, a.IP)
+		} else {
+			second = append(second, a.IP)
+		}
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ips = append(ips, first[i])
+		}
+		if i < len(second) {
+			ips = append(ips, second[i])
+		}
+	}
+
+	return ips
+}
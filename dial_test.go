@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	v4a, v4b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	v6a, v6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	tests := []struct {
+		name string
+		in   []net.IP
+		want []net.IP
+	}{
+		{name: "empty", in: nil, want: []net.IP{}},
+		{name: "single", in: []net.IP{v4a}, want: []net.IP{v4a}},
+		{name: "v4 only", in: []net.IP{v4a, v4b}, want: []net.IP{v4a, v4b}},
+		{name: "v6 first", in: []net.IP{v6a, v6b, v4a, v4b}, want: []net.IP{v6a, v4a, v6b, v4b}},
+		{name: "v4 first", in: []net.IP{v4a, v6a, v6b}, want: []net.IP{v4a, v6a, v6b}},
+		{name: "more v4", in: []net.IP{v4a, v4b, v6a}, want: []net.IP{v4a, v6a, v4b}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := make([]net.IPAddr, len(tt.in))
+			for i, ip := range tt.in {
+				addrs[i] = net.IPAddr{IP: ip}
+			}
+
+			if got := interleaveFamilies(addrs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("interleaveFamilies(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
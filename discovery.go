@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscoveryConfig makes the port's node list come from a cloud provider API
+// instead of the config file
+type DiscoveryConfig struct {
+	Provider   string `yaml:"provider"`              // "gcp_memorystore" or "azure_cache"
+	Instance   string `yaml:"instance,omitempty"`    // GCP: projects/<project>/locations/<region>/instances/<id>
+	ResourceID string `yaml:"resource_id,omitempty"` // Azure: /subscriptions/.../providers/Microsoft.Cache/Redis/<name>
+	Interval   int    `yaml:"interval,omitempty"`    // seconds between lookups, 30 by default
+}
+
+type discoverer interface {
+	// discover returns the instance's endpoints as "host:port" nodes
+	discover(ctx context.Context) ([]string, error)
+}
+
+var (
+	discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+	// metadata services are only reachable from the VM itself, never through HTTP_PROXY
+	metadataClient = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{Proxy: nil}}
+)
+
+func newDiscoverer(c DiscoveryConfig) (discoverer, error) {
+	switch c.Provider {
+	case "gcp_memorystore":
+		if c.Instance == "" {
+			return nil, fmt.Errorf("instance must be set for gcp_memorystore")
+		}
+		return &memorystoreDiscoverer{instance: c.Instance}, nil
+	case "azure_cache":
+		if c.ResourceID == "" {
+			return nil, fmt.Errorf("resource_id must be set for azure_cache")
+		}
+		return &azureCacheDiscoverer{resourceID: c.ResourceID}, nil
+	}
+
+	return nil, fmt.Errorf("unknown provider %q, expected gcp_memorystore or azure_cache", c.Provider)
+}
+
+// runDiscovery periodically replaces the port's node list with the discovered one
+func runDiscovery(ctx context.Context, p *RedisPort, d discoverer, interval time.Duration) {
+	for ; ctx.Err() == nil; sleepContext(ctx, interval) {
+		nodes, err := d.discover(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Node discovery for port %s failed: %s\n", p.port, err)
+			}
+			continue
+		}
+
+		if len(nodes) == 0 {
+			log.Printf("Node discovery for port %s returned no endpoints, keeping the current nodes\n", p.port)
+			continue
+		}
+
+		p.mutex.Lock()
+		changed := strings.Join(p.nodes, ",") != strings.Join(nodes, ",")
+		if changed {
+			p.nodes = nodes
+		}
+		p.mutex.Unlock()
+
+		if changed {
+			log.Printf("Discovered nodes for port %s: %s\n", p.port, strings.Join(nodes, ", "))
+
+			select {
+			case p.probeNow <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// memorystoreDiscoverer uses GCP Memorystore for Redis API with the service account
+// of the VM (or GKE workload) taken from the metadata server
+type memorystoreDiscoverer struct {
+	instance string
+	token    cachedToken
+}
+
+func (d *memorystoreDiscoverer) discover(ctx context.Context) ([]string, error) {
+	token, err := d.token.get(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var instance struct {
+		State            string `json:"state"`
+		Host             string `json:"host"`
+		Port             int    `json:"port"`
+		ReadEndpoint     string `json:"readEndpoint"`
+		ReadEndpointPort int    `json:"readEndpointPort"`
+	}
+
+	if err := getJSON(ctx, "https://redis.googleapis.com/v1/"+d.instance, token, &instance); err != nil {
+		return nil, err
+	}
+
+	if instance.Host == "" {
+		return nil, fmt.Errorf("instance %s has no endpoint (state %s)", d.instance, instance.State)
+	}
+
+	nodes := []string{net.JoinHostPort(instance.Host, strconv.Itoa(instance.Port))}
+	if instance.ReadEndpoint != "" {
+		nodes = append(nodes, net.JoinHostPort(instance.ReadEndpoint, strconv.Itoa(instance.ReadEndpointPort)))
+	}
+
+	return nodes, nil
+}
+
+// azureCacheDiscoverer uses Azure Resource Manager API with the managed identity
+// of the VM taken from the instance metadata service
+type azureCacheDiscoverer struct {
+	resourceID string
+	token      cachedToken
+}
+
+func (d *azureCacheDiscoverer) discover(ctx context.Context) ([]string, error) {
+	token, err := d.token.get(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource="+
+			url.QueryEscape("https://management.azure.com/"), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cache struct {
+		Properties struct {
+			ProvisioningState string `json:"provisioningState"`
+			HostName          string `json:"hostName"`
+			Port              int    `json:"port"`
+			EnableNonSslPort  bool   `json:"enableNonSslPort"`
+		} `json:"properties"`
+	}
+
+	if err := getJSON(ctx, "https://management.azure.com"+d.resourceID+"?api-version=2023-08-01", token, &cache); err != nil {
+		return nil, err
+	}
+
+	props := cache.Properties
+	if props.HostName == "" {
+		return nil, fmt.Errorf("cache %s has no host name (state %s)", d.resourceID, props.ProvisioningState)
+	}
+
+	if !props.EnableNonSslPort {
+		return nil, fmt.Errorf("cache %s has non-TLS port disabled, which is the only one supported", d.resourceID)
+	}
+
+	return []string{net.JoinHostPort(props.HostName, strconv.Itoa(props.Port))}, nil
+}
+
+// cachedToken keeps an OAuth access token from a metadata service until it's about to expire
+type cachedToken struct {
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *cachedToken) get(ctx context.Context, newRequest func() (*http.Request, error)) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   json.RawMessage `json:"expires_in"` // a number on GCP, a string on Azure
+	}
+
+	if err := doJSON(metadataClient, req.WithContext(ctx), &resp); err != nil {
+		return "", fmt.Errorf("can't get access token: %s", err)
+	}
+
+	expiresIn, _ := strconv.Atoi(strings.Trim(string(resp.ExpiresIn), `"`))
+
+	t.token = resp.AccessToken
+	t.expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+
+	return t.token, nil
+}
+
+func getJSON(ctx context.Context, url, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return doJSON(discoveryClient, req, v)
+}
+
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
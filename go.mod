@@ -4,5 +4,9 @@ go 1.19
 
 require (
 	github.com/iguanesolutions/go-systemd/v5 v5.1.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.17.0
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+require golang.org/x/sys v0.15.0 // indirect
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	systemdnotify "github.com/iguanesolutions/go-systemd/v5/notify"
@@ -19,29 +24,154 @@ import (
 
 type RedisPort struct {
 	mutex      sync.RWMutex
-	masterAddr *net.TCPAddr
+	master     string // node ("host:port") elected as master, empty if no master found
+	masterAddr string // its address as passed to dialBackendAddr
+	lastMaster string // the most recently elected master, kept while no master is found
 	port       string
+	nodes      []string
+	config     PortConfig
+
+	disabled bool                  // don't proxy new connections
+	listener *net.TCPListener      // nil while closed by disabling
+	relisten chan *net.TCPListener // passes reopened listener to ServePort
+
+	// on shutdown listenCtx, probeCtx and pipeCtx are cancelled in this
+	// order, closing the listener, stopping probes and then closing pipes
+	listenCtx context.Context
+	probeCtx  context.Context
+	pipeCtx   context.Context
+
+	// probes of the port are made within dialCtx, and new client connections are
+	// checked and dialed within clientCtx; both are cancelled when the port is
+	// disabled and recreated from probeCtx and pipeCtx on enabling
+	dialCtx     context.Context
+	clientCtx   context.Context
+	cancelDials context.CancelFunc
+
+	probeNow chan struct{} // wakes followMaster up before the next scheduled probe
+
+	discoverer discoverer // when set, nodes are updated by runDiscovery
+
+	// during a failover drill the master drillNode is ignored until drillUntil
+	drillNode  string
+	drillUntil time.Time
+
+	sessionsMutex sync.Mutex
+	sessions      map[*session]struct{}
+
+	// replication offset progression of the master, see checkReplOffset
+	bytesToMaster   uint64 // sent by clients, updated atomically
+	replOffset      int64
+	replBytes       uint64
+	replStallCycles int
+	masterStalled   bool
 }
 
 type Stats struct {
 	connectionsProxied uint64
 	pipesActive        uint32
+	connectionsPending uint32 // being checked or dialed, not piped yet
+	authFailures       uint64
+	nonRESPRejected    uint64
+	connectionsShed    uint64
+	replStalls         uint64
+	bufferedBytes      int64 // estimate, see reserveMemory
+}
+
+type NodeStats struct {
+	authFailures uint64
+
+	mutex sync.Mutex
+	state string // result of the last probe, one of nodeState* constants
+}
+
+const (
+	nodeStateMaster      = "master"
+	nodeStateReplica     = "replica"
+	nodeStateLoading     = "loading"
+	nodeStateAuthFailed  = "auth_failed"
+	nodeStateProtected   = "protected_mode"
+	nodeStateUnreachable = "unreachable"
+	nodeStateError       = "error"
+)
+
+// PortConfig describes a single listener; in YAML it may be given
+// either as a bare port number or as a mapping with extra options
+type PortConfig struct {
+	Port    string   `yaml:"port"`
+	Listen  string   `yaml:"listen,omitempty"`  // bind address, all addresses if empty
+	Network string   `yaml:"network,omitempty"` // "tcp4", "tcp6" or "dual" (default)
+	V6Only  *bool    `yaml:"v6only,omitempty"`  // override IPV6_V6ONLY for IPv6 sockets, takes precedence over Network
+	Nodes   []string `yaml:"nodes,omitempty"`   // overrides global nodes list
+
+	Discovery *DiscoveryConfig `yaml:"discovery,omitempty"`
+}
+
+func (pc *PortConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&pc.Port); err == nil {
+		return nil
+	}
+
+	type plain PortConfig
+	return unmarshal((*plain)(pc))
 }
 
 type ConfigStruct struct {
-	Ports []string `yaml:"ports"`
-	Nodes []string `yaml:"nodes"`
-	Auth  string   `yaml:"auth"`
+	Ports []PortConfig `yaml:"ports"`
+	Nodes []string     `yaml:"nodes,omitempty"`
+	Auth  string       `yaml:"auth,omitempty"`
 
 	ProxyConnectionTimeout int `yaml:"proxy_connection_timeout"`
+
+	DialStagger   int    `yaml:"dial_stagger_ms"`
+	UpstreamProxy string `yaml:"upstream_proxy,omitempty"`
+
+	SSHTunnel *SSHTunnelConfig `yaml:"ssh_tunnel,omitempty"`
+
+	AdminListen          string   `yaml:"admin_listen,omitempty"`
+	TunnelListen         string   `yaml:"tunnel_listen,omitempty"`
+	TunnelAllowedOrigins []string `yaml:"tunnel_allowed_origins,omitempty"`
+
+	RequireRESP       bool     `yaml:"require_resp"`
+	RESPAllowedInline []string `yaml:"resp_allowed_inline,omitempty"`
+	RESPCheckTimeout  int      `yaml:"resp_check_timeout"`
+
+	MasterChangePolicy string `yaml:"master_change_policy"`
+	KillStaleClients   bool   `yaml:"kill_stale_clients"`
+
+	ReplStallCycles int `yaml:"repl_stall_cycles"`
+
+	CopyBufferSize int `yaml:"copy_buffer_size"`
+	MemoryLimit    int `yaml:"memory_limit_mb"`
+
+	ProbeRetryBackoff int `yaml:"probe_retry_backoff_ms"`
+	ProbeCycleTimeout int `yaml:"probe_cycle_timeout"`
+
+	ShutdownDrain        string `yaml:"shutdown_drain"`
+	ShutdownDrainTimeout int    `yaml:"shutdown_drain_timeout"`
 }
 
 var (
 	config ConfigStruct = ConfigStruct{
 		ProxyConnectionTimeout: 10,
+		DialStagger:            250,
+		CopyBufferSize:         32 * 1024,
+		MasterChangePolicy:     "keep",
+		ProbeRetryBackoff:      200,
+		ProbeCycleTimeout:      10,
+		ShutdownDrain:          "close",
+		ShutdownDrainTimeout:   30,
 	}
 
+	configFile  string
+	configMutex sync.Mutex // guards config changes made at runtime
+
+	redisPorts = map[string]*RedisPort{} // filled on startup, read-only afterwards
+
+	startTime = time.Now()
+
 	globalStats Stats
+	nodeStats   sync.Map // "node:port" -> *NodeStats
 )
 
 func main() {
@@ -60,6 +190,8 @@ func main() {
 
 	log.Printf("Using onfiguration file %s\n", fn)
 
+	configFile = fn
+
 	f, err := os.Open(fn)
 	if err != nil {
 		log.Fatalf("Can't open config file: %s\n", err)
@@ -76,16 +208,151 @@ func main() {
 		log.Fatalln("Must specify at least one listening port!")
 	}
 
-	if len(config.Nodes) < 1 {
-		log.Fatalln("Must specify at least one redis node!")
+	if config.CopyBufferSize < 1024 {
+		log.Fatalln("copy_buffer_size must be at least 1024 bytes!")
+	}
+
+	if config.MasterChangePolicy != "keep" && config.MasterChangePolicy != "close" {
+		log.Fatalf("Unknown master_change_policy %q, expected keep or close\n", config.MasterChangePolicy)
+	}
+
+	if config.ShutdownDrain != "close" && config.ShutdownDrain != "wait" {
+		log.Fatalf("Unknown shutdown_drain %q, expected close or wait\n", config.ShutdownDrain)
 	}
 
-	log.Printf("Watching the following redis servers: %s", strings.Join(config.Nodes, ", "))
+	if config.KillStaleClients && (config.UpstreamProxy != "" || config.SSHTunnel != nil) {
+		log.Println("kill_stale_clients has no effect with upstream_proxy or ssh_tunnel, connections can't be matched on Redis side")
+	}
+
+	if config.ProbeCycleTimeout < 1 {
+		log.Fatalln("probe_cycle_timeout must be at least 1 second!")
+	}
+
+	if config.UpstreamProxy != "" && config.SSHTunnel != nil {
+		log.Fatalln("upstream_proxy and ssh_tunnel can't be used together!")
+	}
+
+	if config.UpstreamProxy != "" {
+		if err := setupUpstreamProxy(config.UpstreamProxy); err != nil {
+			log.Fatalf("Can't use upstream proxy: %s\n", err)
+		}
+	}
+
+	if config.SSHTunnel != nil {
+		d, err := newSSHDialer(*config.SSHTunnel)
+		if err != nil {
+			log.Fatalf("Can't use SSH tunnel: %s\n", err)
+		}
+
+		upstreamDialer = d
+	}
+
+	listenCtx, closeListeners := context.WithCancel(context.Background())
+	probeCtx, stopProbes := context.WithCancel(context.Background())
+	pipeCtx, closePipes := context.WithCancel(context.Background())
+
+	var ports []string
+	for _, pc := range config.Ports {
+		switch pc.Network {
+		case "", "dual", "tcp4", "tcp6":
+		default:
+			log.Fatalf("Unknown network %q for port %s, expected tcp4, tcp6 or dual\n", pc.Network, pc.Port)
+		}
+
+		if pc.V6Only != nil && pc.Network == "tcp4" {
+			log.Fatalf("v6only can't be used with tcp4 network for port %s\n", pc.Port)
+		}
+
+		if _, ok := redisPorts[pc.Port]; ok {
+			log.Fatalf("Port %s is listed more than once!\n", pc.Port)
+		}
+
+		p := &RedisPort{
+			port:     pc.Port,
+			nodes:    pc.Nodes,
+			config:   pc,
+			relisten: make(chan *net.TCPListener, 1),
+			probeNow: make(chan struct{}, 1),
+			sessions: map[*session]struct{}{},
+
+			listenCtx: listenCtx,
+			probeCtx:  probeCtx,
+			pipeCtx:   pipeCtx,
+		}
+		p.newDialContexts()
+		if pc.Discovery != nil {
+			d, err := newDiscoverer(*pc.Discovery)
+			if err != nil {
+				log.Fatalf("Can't use discovery for port %s: %s\n", pc.Port, err)
+			}
+
+			p.discoverer = d
+		} else if len(p.nodes) == 0 {
+			p.nodes = config.Nodes
+		}
+
+		if len(p.nodes) < 1 && p.discoverer == nil {
+			log.Fatalln("Must specify at least one redis node!")
+		}
+
+		if len(pc.Nodes) > 0 {
+			log.Printf("Watching the following redis servers for port %s: %s", pc.Port, strings.Join(pc.Nodes, ", "))
+		}
+
+		redisPorts[pc.Port] = p
+		ports = append(ports, pc.Port)
+	}
+
+	if len(config.Nodes) > 0 {
+		log.Printf("Watching the following redis servers: %s", strings.Join(config.Nodes, ", "))
+	}
+
+	log.Printf("Serving the following ports: %s", strings.Join(ports, ", "))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Printf("Serving the following ports: %s", strings.Join(config.Ports, ", "))
+	var listeners, probes sync.WaitGroup
 
-	for _, port := range config.Ports {
-		go ServePort(port)
+	for _, p := range redisPorts {
+		p := p
+
+		if p.discoverer != nil {
+			interval := p.config.Discovery.Interval
+			if interval < 1 {
+				interval = 30
+			}
+
+			probes.Add(1)
+			go func() {
+				defer probes.Done()
+				runDiscovery(probeCtx, p, p.discoverer, time.Duration(interval)*time.Second)
+			}()
+		}
+
+		probes.Add(1)
+		go func() {
+			defer probes.Done()
+			followMaster(probeCtx, p)
+		}()
+
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			ServePort(listenCtx, p)
+		}()
+	}
+
+	if config.AdminListen != "" {
+		go serveAdmin(config.AdminListen)
+	}
+
+	if config.TunnelListen != "" {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			serveTunnel(listenCtx, config.TunnelListen)
+		}()
 	}
 
 	if err := systemdnotify.Ready(); err != nil {
@@ -97,17 +364,51 @@ func main() {
 
 	// just update systemd status time to time
 	for {
-		time.Sleep(time.Second * 5)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			// a second signal kills the process right away
+			stop()
+			systemdnotify.Stopping()
+
+			log.Println("Shutting down: closing listeners")
+			closeListeners()
+			listeners.Wait()
+
+			log.Println("Shutting down: stopping probes")
+			stopProbes()
+			probes.Wait()
+
+			drainPipes(closePipes)
+
+			log.Printf("Stopped after %s, proxied: %d, auth failures: %d, non-RESP rejected: %d, shed: %d, replication stalls: %d\n",
+				time.Since(startTime).Round(time.Second),
+				atomic.LoadUint64(&globalStats.connectionsProxied),
+				atomic.LoadUint64(&globalStats.authFailures),
+				atomic.LoadUint64(&globalStats.nonRESPRejected),
+				atomic.LoadUint64(&globalStats.connectionsShed),
+				atomic.LoadUint64(&globalStats.replStalls))
+			return
+		}
 
 		var delta float64
 		var rateProxied float64
 		delta, ratePeriodStart = time.Since(ratePeriodStart).Seconds(), time.Now()
 		rateProxied, rateProxiedValue = float64(globalStats.connectionsProxied-rateProxiedValue)/delta, globalStats.connectionsProxied
 
-		statusString := fmt.Sprintf("Active connections: %d, proxied: %d, rate: %.1f/sec",
+		stale := 0
+		for _, p := range redisPorts {
+			stale += len(p.staleSessions())
+		}
+
+		statusString := fmt.Sprintf("Active connections: %d (%d on stale master), proxied: %d, rate: %.1f/sec, auth failures: %d, non-RESP rejected: %d, shed: %d",
 			globalStats.pipesActive/2,
+			stale,
 			globalStats.connectionsProxied,
-			rateProxied)
+			rateProxied,
+			atomic.LoadUint64(&globalStats.authFailures),
+			atomic.LoadUint64(&globalStats.nonRESPRejected),
+			atomic.LoadUint64(&globalStats.connectionsShed))
 
 		if systemdnotify.IsEnabled() {
 			systemdnotify.Status(statusString)
@@ -117,127 +418,671 @@ func main() {
 	}
 }
 
-func ServePort(port string) {
-	var p RedisPort
+func ServePort(ctx context.Context, p *RedisPort) {
+	port := p.port
 
-	p.port = port
-
-	laddr, err := net.ResolveTCPAddr("tcp", ":"+port)
+	listener, err := listen(p.config)
 	if err != nil {
-		log.Fatalf("Failed to resolve listen address: %s\n", err)
+		log.Fatalf("Can't open listening socket for port %s: %s\n", port, err)
 	}
 
-	go followMaster(&p)
+	p.mutex.Lock()
+	p.listener = listener
+	p.mutex.Unlock()
 
-	listener, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		log.Fatalf("Can't open listening socket for port %s: %s\n", port, err)
-	}
+	// on shutdown only the listener is closed, probes and connections
+	// are stopped later
+	go func() {
+		<-ctx.Done()
+
+		p.mutex.Lock()
+		if p.listener != nil {
+			p.listener.Close()
+			p.listener = nil
+		}
+		p.mutex.Unlock()
+	}()
 
 	for {
 		conn, err := listener.AcceptTCP()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// closed by disabling the port, wait until it's enabled again
+				select {
+				case listener = <-p.relisten:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
 			log.Printf("Can't accept connection on port %s: %s\n", port, err)
 			continue
 		}
 
-		p.mutex.RLock()
+		p.handleClient(conn)
+	}
+}
+
+// drainPipes handles connections left after shutdown per shutdown_drain:
+// they are either closed right away or given some time to finish by themselves
+func drainPipes(closePipes context.CancelFunc) {
+	if config.ShutdownDrain == "wait" && openConnections() > 0 {
+		log.Printf("Shutting down: waiting up to %d seconds for %d connections to finish\n",
+			config.ShutdownDrainTimeout, openConnections())
 
-		if p.masterAddr != nil {
-			atomic.AddUint64(&globalStats.connectionsProxied, 1)
-			go proxy(conn, p.masterAddr)
-		} else {
-			conn.Close()
+		deadline := time.Now().Add(time.Duration(config.ShutdownDrainTimeout) * time.Second)
+		for openConnections() > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
 		}
+	}
 
-		p.mutex.RUnlock()
+	if n := openConnections(); n > 0 {
+		log.Printf("Shutting down: closing %d connections\n", n)
 	}
 
+	closePipes()
+
+	// let pipes notice it, closing is quick
+	for i := 0; openConnections() > 0 && i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
-func followMaster(rp *RedisPort) {
-	for {
-		var newAddr *net.TCPAddr
-		for attempt := 1; newAddr == nil && attempt <= 3; attempt++ {
-			newAddr = getMasterAddr(rp.port, attempt)
+// openConnections counts proxied connections including the ones not piped yet
+func openConnections() uint32 {
+	return atomic.LoadUint32(&globalStats.pipesActive)/2 + atomic.LoadUint32(&globalStats.connectionsPending)
+}
+
+// handleClient proxies a new client connection to the current master,
+// closing it if there's no master or the port is disabled
+func (p *RedisPort) handleClient(conn io.ReadWriteCloser) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.master != "" && !p.disabled {
+		go proxy(p.pipeCtx, p, conn, p.master, p.masterAddr)
+	} else {
+		conn.Close()
+	}
+}
+
+// dialContext returns the context for probes of the port's nodes,
+// it's cancelled when the port gets disabled
+func (p *RedisPort) dialContext() context.Context {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.dialCtx
+}
+
+// clientContext returns the context for connecting new clients to the master,
+// it's cancelled when the port gets disabled
+func (p *RedisPort) clientContext() context.Context {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.clientCtx
+}
+
+// newDialContexts must be called with p.mutex held
+func (p *RedisPort) newDialContexts() {
+	var cancelProbes, cancelClients context.CancelFunc
+
+	p.dialCtx, cancelProbes = context.WithCancel(p.probeCtx)
+	p.clientCtx, cancelClients = context.WithCancel(p.pipeCtx)
+	p.cancelDials = func() {
+		cancelProbes()
+		cancelClients()
+	}
+}
+
+// disablePort stops proxying new connections to the port, optionally closing
+// its listener so that clients get "connection refused"; established
+// connections are not affected
+func disablePort(p *RedisPort, closeListener bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// the master isn't followed while disabled, so it's unknown until the next probe
+	p.disabled = true
+	p.cancelDials()
+	p.master, p.masterAddr = "", ""
+
+	if closeListener && p.listener != nil {
+		p.listener.Close()
+		p.listener = nil
+	}
+}
+
+func enablePort(p *RedisPort) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listenCtx.Err() != nil {
+		return fmt.Errorf("shutting down")
+	}
+
+	if p.listener == nil {
+		listener, err := listen(p.config)
+		if err != nil {
+			return err
 		}
 
-		if newAddr == nil {
-			log.Printf("No masters found for port %s! Will not serve new connections until master is found...", rp.port)
-		} else if rp.masterAddr == nil || string(rp.masterAddr.IP) != string(newAddr.IP) || rp.masterAddr.Port != newAddr.Port {
-			log.Printf("Changing master to %s:%d\n", newAddr.IP, newAddr.Port)
+		p.listener = listener
+		p.relisten <- listener
+	}
+
+	if p.disabled {
+		p.newDialContexts()
+
+		// find the master right away, no clients are proxied until then
+		select {
+		case p.probeNow <- struct{}{}:
+		default:
+		}
+	}
+
+	p.disabled = false
+
+	return nil
+}
+
+func listen(pc PortConfig) (*net.TCPListener, error) {
+	var lc net.ListenConfig
+
+	if pc.V6Only != nil {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			if network != "tcp6" {
+				return nil
+			}
+
+			return setV6Only(c, *pc.V6Only)
+		}
+	}
+
+	network := pc.Network
+	if network == "" || network == "dual" {
+		network = "tcp"
+	}
+
+	l, err := lc.Listen(context.Background(), network, net.JoinHostPort(pc.Listen, pc.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	return l.(*net.TCPListener), nil
+}
+
+func followMaster(ctx context.Context, rp *RedisPort) {
+	for ; ctx.Err() == nil; rp.waitNextProbe(ctx) {
+		// probes are stopped while the port is disabled
+		probeCtx := rp.dialContext()
+		if probeCtx.Err() != nil {
+			continue
+		}
+
+		// the whole cycle (all attempts and backoffs) must fit into probe_cycle_timeout
+		deadline := time.Now().Add(time.Duration(config.ProbeCycleTimeout) * time.Second)
+
+		var newMaster, newAddr, ignore string
+		var replOffset int64
+		for attempt := 1; newMaster == "" && attempt <= 3; attempt++ {
+			if attempt > 1 {
+				backoff := time.Duration(config.ProbeRetryBackoff*(attempt-1)) * time.Millisecond
+				if time.Until(deadline) <= backoff || !sleepContext(probeCtx, backoff) {
+					break
+				}
+			}
+
+			rp.mutex.Lock()
+			nodes := rp.nodes
+			if rp.drillNode != "" && time.Now().After(rp.drillUntil) {
+				log.Printf("Failover drill on port %s finished, %s is no longer ignored\n", rp.port, rp.drillNode)
+				rp.drillNode = ""
+			}
+			ignore = rp.drillNode
+			rp.mutex.Unlock()
+
+			newMaster, newAddr, replOffset = getMaster(probeCtx, nodes, rp.port, ignore, attempt, deadline)
+		}
+
+		// interrupted, the results are incomplete
+		if probeCtx.Err() != nil {
+			continue
 		}
 
 		rp.mutex.Lock()
-		rp.masterAddr = newAddr
+
+		// the port was disabled meanwhile, or a drill started and the result
+		// may be the master to be ignored
+		if probeCtx.Err() != nil || rp.drillNode != ignore {
+			rp.mutex.Unlock()
+			continue
+		}
+
+		// a short period without master (e.g. while it's loading) is not a master change
+		prevMaster, oldMaster := rp.master, rp.lastMaster
+		rp.master, rp.masterAddr = newMaster, newAddr
+		if newMaster != "" {
+			rp.lastMaster = newMaster
+		}
+
 		rp.mutex.Unlock()
 
-		time.Sleep(1 * time.Second)
+		if newMaster == "" {
+			log.Printf("No masters found for port %s! Will not serve new connections until master is found...", rp.port)
+		} else if prevMaster != newMaster {
+			log.Printf("Changing master to %s\n", newMaster)
+		}
+
+		if newMaster != "" && oldMaster != newMaster {
+			sessions := rp.masterLost(oldMaster)
+			if config.KillStaleClients && len(sessions) > 0 {
+				go killStaleClients(ctx, oldMaster, sessions)
+			}
+
+			if stale := rp.staleSessions(); len(stale) > 0 && config.MasterChangePolicy == "keep" {
+				log.Printf("%d connections of port %s are still attached to previous master(s)\n", len(stale), rp.port)
+			}
+		}
+
+		if newMaster != "" && config.ReplStallCycles > 0 {
+			rp.checkReplOffset(newMaster, oldMaster != newMaster, replOffset)
+		}
+	}
+}
+
+// checkReplOffset flags the master whose master_repl_offset stays the same for
+// repl_stall_cycles probes in a row while clients keep sending data to it: it still
+// answers INFO, but may be wedged. Read-only traffic doesn't advance the offset
+// either, so it's only an extra signal, the master is used as before
+func (p *RedisPort) checkReplOffset(master string, changed bool, offset int64) {
+	sent := atomic.LoadUint64(&p.bytesToMaster)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if changed || offset != p.replOffset {
+		if p.masterStalled {
+			log.Printf("Master %s of port %s advances replication offset again\n", master, p.port)
+		}
+
+		p.replOffset, p.replBytes, p.replStallCycles, p.masterStalled = offset, sent, 0, false
+		return
+	}
+
+	if sent == p.replBytes {
+		return // no client traffic, nothing to expect
+	}
+
+	p.replBytes = sent
+	p.replStallCycles++
+
+	if p.replStallCycles == config.ReplStallCycles {
+		p.masterStalled = true
+		atomic.AddUint64(&globalStats.replStalls, 1)
+		log.Printf("Master %s of port %s hasn't advanced replication offset (%d) for %d probes despite client traffic, it may be wedged\n",
+			master, p.port, offset, p.replStallCycles)
+	}
+}
+
+// waitNextProbe pauses between probe cycles, unless a probe is requested via probeNow
+func (p *RedisPort) waitNextProbe(ctx context.Context) {
+	t := time.NewTimer(1 * time.Second)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-p.probeNow:
+	case <-ctx.Done():
+	}
+}
+
+// startDrill simulates loss of the current master: it's ignored by probes
+// for the given time, and its connections are handled per master_change_policy
+// and kill_stale_clients
+func startDrill(p *RedisPort, d time.Duration) (string, time.Time, error) {
+	p.mutex.Lock()
+
+	master := p.master
+	if master == "" {
+		p.mutex.Unlock()
+		return "", time.Time{}, fmt.Errorf("port %s has no master", p.port)
+	}
+
+	p.drillNode = master
+	p.drillUntil = time.Now().Add(d)
+	p.master, p.masterAddr, p.lastMaster = "", "", ""
+	until := p.drillUntil
+
+	p.mutex.Unlock()
+
+	log.Printf("Failover drill on port %s: ignoring master %s for %s\n", p.port, master, d)
+
+	sessions := p.masterLost(master)
+	if config.KillStaleClients && len(sessions) > 0 {
+		go killStaleClients(p.probeCtx, master, sessions)
+	}
+
+	select {
+	case p.probeNow <- struct{}{}:
+	default:
+	}
+
+	return master, until, nil
+}
+
+// sleepContext pauses for d, returning false if ctx was cancelled meanwhile
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// splitNode returns node's host and port, which defaults to the listening port
+func splitNode(node, port string) (string, string) {
+	if host, nodePort, err := net.SplitHostPort(node); err == nil {
+		return host, nodePort
+	}
+
+	return strings.Trim(node, "[]"), port
+}
+
+func getNodeStats(node, port string) *NodeStats {
+	ns, _ := nodeStats.LoadOrStore(net.JoinHostPort(node, port), &NodeStats{})
+	return ns.(*NodeStats)
+}
+
+// setState records the result of the node's probe, returning true if it has changed
+func (ns *NodeStats) setState(state string) bool {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	changed := ns.state != state
+	ns.state = state
+
+	return changed
+}
+
+func (ns *NodeStats) getState() string {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	return ns.state
+}
+
+// isProtectedMode checks for the error Redis sends to non-local clients when it
+// runs in protected mode (no password set and not bound to specific addresses)
+func isProtectedMode(err error) bool {
+	_, ok := err.(redisError)
+	return ok && strings.HasPrefix(err.Error(), "DENIED") && strings.Contains(err.Error(), "protected mode")
+}
+
+// countAuthFailure counts every rejected probe, while it's logged only on state change
+func countAuthFailure(ns *NodeStats) {
+	atomic.AddUint64(&globalStats.authFailures, 1)
+	atomic.AddUint64(&ns.authFailures, 1)
+}
+
+// isNoPassword tells whether the AUTH error means that the node has no password set,
+// worded differently before and after Redis 6
+func isNoPassword(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "no password is set") || strings.Contains(msg, "without any password configured")
+}
+
+func reportProtectedMode(ns *NodeStats, node, port string) {
+	if ns.setState(nodeStateProtected) {
+		log.Printf("%s:%s: Redis is running in protected mode and refuses remote connections, set a password or disable protected-mode on it\n", node, port)
 	}
 }
 
-func proxy(local io.ReadWriteCloser, remoteAddr *net.TCPAddr) {
-	d := net.Dialer{Timeout: time.Duration(config.ProxyConnectionTimeout) * time.Second}
-	remote, err := d.Dial("tcp", remoteAddr.String())
+// proxy connects the client to the master node at remoteAddr; the connection
+// lives until either side closes it or ctx is cancelled
+func proxy(ctx context.Context, p *RedisPort, local io.ReadWriteCloser, master, remoteAddr string) {
+	// a copy buffer for each direction, reserved before the connection is held any longer
+	bufSize := int64(config.CopyBufferSize)
+	if !reserveMemory(2 * bufSize) {
+		local.Close()
+		return
+	}
+
+	atomic.AddUint64(&globalStats.connectionsProxied, 1)
+
+	setKeepAlive(local)
+
+	// counted until the pipes start, so that shutdown_drain waits for it too
+	atomic.AddUint32(&globalStats.connectionsPending, 1)
+	defer atomic.AddUint32(&globalStats.connectionsPending, ^uint32(0))
+
+	client := clientAddr(local)
+	dialCtx := p.clientContext()
+
+	if config.RequireRESP {
+		stop := closeOnDone(dialCtx, local)
+		head, err := sniffRESP(local)
+		stop()
+		if err != nil {
+			atomic.AddUint64(&globalStats.nonRESPRejected, 1)
+			releaseMemory(2 * bufSize)
+			local.Close()
+			return
+		}
+
+		local = &prefixedConn{local, io.MultiReader(bytes.NewReader(head), local)}
+	}
+
+	dialCtx, cancel := context.WithTimeout(dialCtx, time.Duration(config.ProxyConnectionTimeout)*time.Second)
+	remote, _, err := dialBackendAddr(dialCtx, remoteAddr)
+	cancel()
 	if err != nil {
 		log.Println(err)
+		releaseMemory(2 * bufSize)
 		local.Close()
 		return
 	}
 
-	local.(*net.TCPConn).SetKeepAlive(true)
-	local.(*net.TCPConn).SetKeepAlivePeriod(5 * time.Second)
+	setKeepAlive(remote)
+
+	s := &session{client: client, master: master, local: local, remote: remote, pipes: 2}
+	if upstreamDialer == nil {
+		s.backendAddr = remote.LocalAddr().String()
+	}
+	p.addSession(s)
 
-	remote.(*net.TCPConn).SetKeepAlive(true)
-	remote.(*net.TCPConn).SetKeepAlivePeriod(5 * time.Second)
+	go func() {
+		pipe(ctx, local, &countingWriter{remote, &p.bytesToMaster})
+		p.pipeDone(s)
+	}()
+
+	go func() {
+		pipe(ctx, remote, local)
+		p.pipeDone(s)
+	}()
+}
+
+// countingWriter atomically adds the number of bytes written to *n
+type countingWriter struct {
+	io.WriteCloser
+	n *uint64
+}
 
-	go pipe(local, remote)
-	go pipe(remote, local)
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	atomic.AddUint64(w.n, uint64(n))
+	return n, err
 }
 
-func pipe(r io.ReadCloser, w io.WriteCloser) {
+// closeOnDone closes conns when ctx is cancelled, unless the returned stop func is called first
+func closeOnDone(ctx context.Context, conns ...io.Closer) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, c := range conns {
+				c.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// setKeepAlive enables TCP keepalives if conn is a plain TCP connection
+// (tunneled ones are kept alive by their transport)
+func setKeepAlive(conn interface{}) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(5 * time.Second)
+	}
+}
+
+func pipe(ctx context.Context, r io.ReadCloser, w io.WriteCloser) {
 	atomic.AddUint32(&globalStats.pipesActive, 1)                // increase by 1
 	defer atomic.AddUint32(&globalStats.pipesActive, ^uint32(0)) // decrease by 1
 
+	buf := copyBuffers.Get().(*[]byte)
+	defer releaseMemory(int64(len(*buf)))
+	defer copyBuffers.Put(buf)
+
 	defer r.Close()
 	defer w.Close()
-	io.Copy(w, r)
+	defer closeOnDone(ctx, r, w)()
+	io.CopyBuffer(w, r, *buf)
 }
 
-func getMasterAddr(port string, timeout int) *net.TCPAddr {
-	for _, node := range config.Nodes {
-		d := net.Dialer{Timeout: time.Duration(timeout) * time.Second}
-		conn, err := d.Dial("tcp", node+":"+port)
+// getMaster returns the first master found among the nodes (except ignore) as "host:port",
+// the address it was reached at (to be passed to dialBackendAddr) and its master_repl_offset
+func getMaster(ctx context.Context, nodes []string, port, ignore string, timeout int, deadline time.Time) (string, string, int64) {
+	for _, node := range nodes {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			log.Printf("Probe cycle for port %s exceeded %ds, skipping remaining nodes\n", port, config.ProbeCycleTimeout)
+			break
+		}
+
+		// both dial and reads of a node are limited by the attempt's timeout,
+		// so a node that accepts connections but doesn't answer can't use up the whole cycle
+		nodeDeadline := time.Now().Add(time.Duration(timeout) * time.Second)
+		if nodeDeadline.After(deadline) {
+			nodeDeadline = deadline
+		}
+
+		host, nodePort := splitNode(node, port)
+		ns := getNodeStats(host, nodePort)
+
+		dialCtx, cancel := context.WithDeadline(ctx, nodeDeadline)
+		conn, addr, err := dialBackend(dialCtx, host, nodePort)
+		cancel()
 		if err != nil {
-			if timeout != 1 {
+			if ctx.Err() == nil {
+				ns.setState(nodeStateUnreachable)
+			}
+			if timeout != 1 && ctx.Err() == nil {
 				log.Printf("Can't connect to %s with timeout %ds: %s\n", node, timeout, err)
 			}
 			continue
 		}
 
+		// not every conn supports deadlines (SSH channels don't), so enforce it via context too
+		probeCtx, cancel := context.WithDeadline(ctx, nodeDeadline)
+		defer cancel()
+
 		defer conn.Close()
+		defer closeOnDone(probeCtx, conn)()
+
+		conn.SetDeadline(nodeDeadline)
 
 		if config.Auth != "" {
-			conn.Write([]byte(fmt.Sprintf("AUTH %s\r\ninfo replication\r\n", config.Auth)))
+			conn.Write([]byte(fmt.Sprintf("AUTH %s\r\ninfo replication\r\ninfo persistence\r\n", config.Auth)))
 		} else {
-			conn.Write([]byte("info replication\r\n"))
+			conn.Write([]byte("info replication\r\ninfo persistence\r\n"))
 		}
 
-		b := make([]byte, 4096)
+		r := bufio.NewReader(conn)
+
+		if config.Auth != "" {
+			if _, err := readReply(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					ns.setState(nodeStateError)
+					log.Printf("Can't read Redis response: %s\n", err)
+					continue
+				}
+
+				if isProtectedMode(err) {
+					reportProtectedMode(ns, host, nodePort)
+					continue
+				}
 
-		l, err := conn.Read(b)
+				// a node without password still answers INFO, nothing to report
+				if !isNoPassword(err) {
+					countAuthFailure(ns)
+					if ns.setState(nodeStateAuthFailed) {
+						log.Printf("%s:%s: AUTH failed: %s\n", host, nodePort, err)
+					}
+					continue
+				}
+			}
+		}
+
+		info, err := readReply(r)
 		if err != nil {
-			log.Printf("Can't read Redis response: %s\n", err)
+			if _, ok := err.(redisError); !ok {
+				ns.setState(nodeStateError)
+				log.Printf("Can't read Redis response: %s\n", err)
+			} else if isProtectedMode(err) {
+				reportProtectedMode(ns, host, nodePort)
+			} else if strings.HasPrefix(err.Error(), "NOAUTH") {
+				countAuthFailure(ns)
+				if ns.setState(nodeStateAuthFailed) {
+					log.Printf("%s:%s: NOAUTH Authentication required\n", host, nodePort)
+				}
+			} else if strings.HasPrefix(err.Error(), "LOADING") {
+				if ns.setState(nodeStateLoading) {
+					log.Printf("%s:%s: Redis is loading the dataset, not using it until loaded\n", host, nodePort)
+				}
+			} else {
+				ns.setState(nodeStateError)
+				log.Printf("%s:%s: INFO failed: %s\n", host, nodePort, err)
+			}
+			continue
 		}
 
-		if bytes.Contains(b[:l], []byte("role:master")) {
-			return conn.RemoteAddr().(*net.TCPAddr)
+		// an error here is not fatal, just no loading state info
+		persistence, _ := readReply(r)
+
+		if !strings.Contains(info, "role:master") {
+			ns.setState(nodeStateReplica)
+			continue
 		}
 
-		if bytes.Contains(b[:l], []byte("-NOAUTH")) {
-			log.Printf("%s:%s: NOAUTH Authentication required\n", node, port)
+		if strings.Contains(persistence, "loading:1") {
+			if ns.setState(nodeStateLoading) {
+				log.Printf("%s:%s: master is loading the dataset, not using it until loaded\n", host, nodePort)
+			}
+			continue
+		}
+
+		ns.setState(nodeStateMaster)
+
+		// the node is identified by its name, the address may differ between probes
+		// (e.g. IPv4 and IPv6 of a dual-stack node)
+		if master := net.JoinHostPort(host, nodePort); master != ignore {
+			return master, addr, parseInfoInt(info, "master_repl_offset")
 		}
 	}
 
-	return nil
+	return "", "", 0
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestPortConfigUnmarshalYAML(t *testing.T) {
+	v6only := true
+
+	tests := []struct {
+		name    string
+		in      string
+		want    []PortConfig
+		wantErr bool
+	}{
+		{name: "bare numbers", in: "[6379, 6380]", want: []PortConfig{{Port: "6379"}, {Port: "6380"}}},
+		{name: "quoted number", in: `["6379"]`, want: []PortConfig{{Port: "6379"}}},
+		{
+			name: "mapping",
+			in:   "- port: 6380\n  listen: 192.0.2.10\n  network: tcp6\n  v6only: true\n  nodes: [redis3, redis4:6390]",
+			want: []PortConfig{{Port: "6380", Listen: "192.0.2.10", Network: "tcp6", V6Only: &v6only, Nodes: []string{"redis3", "redis4:6390"}}},
+		},
+		{
+			name: "mixed",
+			in:   "- 6379\n- port: 6380\n  discovery:\n    provider: gcp_memorystore\n    instance: x",
+			want: []PortConfig{{Port: "6379"}, {Port: "6380", Discovery: &DiscoveryConfig{Provider: "gcp_memorystore", Instance: "x"}}},
+		},
+		{name: "list instead of port", in: "- [6379]", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []PortConfig
+			err := yaml.Unmarshal([]byte(tt.in), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitNode(t *testing.T) {
+	tests := []struct {
+		node, host, port string
+	}{
+		{"redis1", "redis1", "6379"},
+		{"redis1:6390", "redis1", "6390"},
+		{"192.0.2.1", "192.0.2.1", "6379"},
+		{"2001:db8::1", "2001:db8::1", "6379"},
+		{"[2001:db8::1]", "2001:db8::1", "6379"},
+		{"[2001:db8::1]:6390", "2001:db8::1", "6390"},
+	}
+
+	for _, tt := range tests {
+		host, port := splitNode(tt.node, "6379")
+		if host != tt.host || port != tt.port {
+			t.Errorf("splitNode(%q) = %q, %q, want %q, %q", tt.node, host, port, tt.host, tt.port)
+		}
+	}
+}
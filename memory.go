@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	copyBuffers = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, config.CopyBufferSize)
+			return &b
+		},
+	}
+
+	shedding uint32 // 1 while new connections are dropped due to memory_limit_mb
+)
+
+// reserveMemory accounts n more bytes of buffered data, failing if that would
+// exceed memory_limit_mb; the estimate includes copy buffers of active pipes
+// and connections still waiting for the master to answer
+func reserveMemory(n int64) bool {
+	if config.MemoryLimit <= 0 {
+		atomic.AddInt64(&globalStats.bufferedBytes, n)
+		return true
+	}
+
+	if atomic.AddInt64(&globalStats.bufferedBytes, n) > int64(config.MemoryLimit)<<20 {
+		atomic.AddInt64(&globalStats.bufferedBytes, -n)
+		atomic.AddUint64(&globalStats.connectionsShed, 1)
+
+		if atomic.CompareAndSwapUint32(&shedding, 0, 1) {
+			log.Printf("Memory limit of %d MB reached, dropping new connections\n", config.MemoryLimit)
+		}
+
+		return false
+	}
+
+	if atomic.CompareAndSwapUint32(&shedding, 1, 0) {
+		log.Println("Memory usage is below the limit again, accepting new connections")
+	}
+
+	return true
+}
+
+func releaseMemory(n int64) {
+	atomic.AddInt64(&globalStats.bufferedBytes, -n)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisError is an error reply (the one starting with "-") sent by Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// readReply reads a single simple string, error, integer or bulk string reply
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		l, err := strconv.Atoi(line[1:])
+		if l == -1 && err == nil {
+			return "", nil // null bulk string
+		}
+		if err != nil || l < 0 {
+			return "", fmt.Errorf("unexpected bulk length: %s", line)
+		}
+
+		b := make([]byte, l+2) // including trailing CRLF
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+
+		return string(b[:l]), nil
+	}
+
+	return "", fmt.Errorf("unexpected reply: %s", line)
+}
+
+// parseInfoInt returns the integer value of the field in INFO output, 0 if it's missing
+func parseInfoInt(info, field string) int64 {
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, field+":") {
+			n, _ := strconv.ParseInt(line[len(field)+1:], 10, 64)
+			return n
+		}
+	}
+
+	return 0
+}
+
+// writeCommand writes a command as RESP array of bulk strings
+func writeCommand(w io.Writer, args ...string) error {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// sniffRESP reads the beginning of the client's first request and checks that it's
+// a RESP array or one of resp_allowed_inline commands; the bytes read are returned
+// so they can be passed to the master
+func sniffRESP(conn io.Reader) ([]byte, error) {
+	if d, ok := conn.(interface{ SetReadDeadline(time.Time) error }); ok && config.RESPCheckTimeout > 0 {
+		d.SetReadDeadline(time.Now().Add(time.Duration(config.RESPCheckTimeout) * time.Second))
+		defer d.SetReadDeadline(time.Time{})
+	}
+
+	buf := make([]byte, 0, 64)
+	for {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if len(buf) >= 2 && buf[0] == '*' {
+			if buf[1] >= '0' && buf[1] <= '9' {
+				return buf, nil
+			}
+			return buf, fmt.Errorf("malformed RESP array")
+		}
+
+		// inline commands are plain words, this cuts off TLS handshakes and other binary junk
+		if len(buf) > 0 && buf[0] != '*' && !isLetter(buf[0]) {
+			return buf, fmt.Errorf("not a RESP request")
+		}
+
+		if i := bytes.IndexAny(buf, " \r\n"); i >= 0 && buf[0] != '*' {
+			cmd := string(buf[:i])
+			for _, allowed := range config.RESPAllowedInline {
+				if strings.EqualFold(cmd, allowed) {
+					return buf, nil
+				}
+			}
+			return buf, fmt.Errorf("inline command %q is not allowed", cmd)
+		}
+
+		if err != nil {
+			return buf, err
+		}
+
+		if len(buf) == cap(buf) {
+			return buf, fmt.Errorf("not a RESP request")
+		}
+	}
+}
+
+// prefixedConn returns already consumed bytes before reading the rest of the connection
+type prefixedConn struct {
+	io.ReadWriteCloser
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func isLetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		wantErr  bool
+		redisErr bool
+	}{
+		{name: "simple string", in: "+OK\r\n", want: "OK"},
+		{name: "integer", in: ":42\r\n", want: "42"},
+		{name: "bulk string", in: "$5\r\nhello\r\n", want: "hello"},
+		{name: "bulk string with CRLF inside", in: "$8\r\nrole:\r\nm\r\n", want: "role:\r\nm"},
+		{name: "empty bulk string", in: "$0\r\n\r\n", want: ""},
+		{name: "null bulk string", in: "$-1\r\n", want: ""},
+		{name: "error", in: "-NOAUTH Authentication required.\r\n", wantErr: true, redisErr: true},
+		{name: "negative bulk length", in: "$-2\r\n", wantErr: true},
+		{name: "bad bulk length", in: "$x\r\n", wantErr: true},
+		{name: "truncated bulk string", in: "$10\r\nhello\r\n", wantErr: true},
+		{name: "array", in: "*1\r\n$2\r\nOK\r\n", wantErr: true},
+		{name: "empty line", in: "\r\n", wantErr: true},
+		{name: "no line end", in: "+OK", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(iotest.OneByteReader(strings.NewReader(tt.in)))
+
+			got, err := readReply(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readReply(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			}
+
+			if _, ok := err.(redisError); ok != tt.redisErr {
+				t.Errorf("readReply(%q) error = %#v, want redisError: %v", tt.in, err, tt.redisErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("readReply(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInfoInt(t *testing.T) {
+	info := "# Replication\r\nrole:master\r\nconnected_slaves:1\r\nmaster_repl_offset:12345\r\n"
+
+	if got := parseInfoInt(info, "master_repl_offset"); got != 12345 {
+		t.Errorf("master_repl_offset = %d, want 12345", got)
+	}
+
+	if got := parseInfoInt(info, "missing"); got != 0 {
+		t.Errorf("missing = %d, want 0", got)
+	}
+}
+
+func TestSniffRESP(t *testing.T) {
+	defer func(allowed []string) { config.RESPAllowedInline = allowed }(config.RESPAllowedInline)
+	config.RESPAllowedInline = []string{"PING"}
+
+	tests := []struct {
+		name    string
+		in      string
+		oneByte bool // deliver input one byte per read
+		wantErr bool
+	}{
+		{name: "array", in: "*1\r\n$4\r\nPING\r\n"},
+		{name: "array in partial reads", in: "*1\r\n$4\r\nPING\r\n", oneByte: true},
+		{name: "lone star", in: "*", wantErr: true},
+		{name: "malformed array", in: "*x\r\n", wantErr: true},
+		{name: "allowed inline", in: "PING\r\n"},
+		{name: "allowed inline in lower case", in: "ping\r\n"},
+		{name: "allowed inline with arguments", in: "PING hello\r\n", oneByte: true},
+		{name: "inline not allowed", in: "GET key\r\n", wantErr: true},
+		{name: "HTTP request", in: "GET / HTTP/1.1\r\nHost: x\r\n\r\n", wantErr: true},
+		{name: "TLS handshake", in: "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", wantErr: true},
+		{name: "inline longer than buffer", in: strings.Repeat("A", 100) + "\r\n", wantErr: true},
+		{name: "inline without line end", in: "PING", wantErr: true},
+		{name: "empty", in: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = strings.NewReader(tt.in)
+			if tt.oneByte {
+				r = iotest.OneByteReader(r)
+			}
+
+			head, err := sniffRESP(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sniffRESP(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			}
+
+			if !strings.HasPrefix(tt.in, string(head)) {
+				t.Errorf("sniffRESP(%q) returned %q, not a prefix of the input", tt.in, head)
+			}
+		})
+	}
+}
+
+func TestWriteCommand(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeCommand(&b, "CLIENT", "KILL", "ADDR", "10.0.0.1:5000"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "*4\r\n$6\r\nCLIENT\r\n$4\r\nKILL\r\n$4\r\nADDR\r\n$13\r\n10.0.0.1:5000\r\n"
+	if b.String() != want {
+		t.Errorf("writeCommand() wrote %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// session is a proxied client connection, tracked per port
+// to handle connections left on the previous master
+type session struct {
+	client string // client address
+	master string // master node the session is connected to, see RedisPort.master
+
+	// local address of the connection to the master, as seen by Redis in CLIENT LIST;
+	// empty when connected through a proxy or tunnel
+	backendAddr string
+
+	local  io.Closer
+	remote io.Closer
+
+	pipes int32 // active pipes, the session is removed when both are done
+}
+
+func (p *RedisPort) addSession(s *session) {
+	p.sessionsMutex.Lock()
+	p.sessions[s] = struct{}{}
+	p.sessionsMutex.Unlock()
+}
+
+func (p *RedisPort) pipeDone(s *session) {
+	if atomic.AddInt32(&s.pipes, -1) != 0 {
+		return
+	}
+
+	p.sessionsMutex.Lock()
+	delete(p.sessions, s)
+	p.sessionsMutex.Unlock()
+}
+
+// sessionsTo returns the sessions connected to the given master
+func (p *RedisPort) sessionsTo(master string) []*session {
+	p.sessionsMutex.Lock()
+	defer p.sessionsMutex.Unlock()
+
+	var list []*session
+	for s := range p.sessions {
+		if s.master == master {
+			list = append(list, s)
+		}
+	}
+
+	return list
+}
+
+// staleSessions returns the sessions still connected to a master
+// other than the last elected one
+func (p *RedisPort) staleSessions() []*session {
+	p.mutex.RLock()
+	master := p.lastMaster
+	p.mutex.RUnlock()
+
+	p.sessionsMutex.Lock()
+	defer p.sessionsMutex.Unlock()
+
+	var list []*session
+	for s := range p.sessions {
+		if s.master != master {
+			list = append(list, s)
+		}
+	}
+
+	return list
+}
+
+// masterLost applies master_change_policy to the sessions
+// still connected to the master that is no longer used
+func (p *RedisPort) masterLost(oldMaster string) []*session {
+	if oldMaster == "" {
+		return nil
+	}
+
+	sessions := p.sessionsTo(oldMaster)
+	if len(sessions) == 0 || config.MasterChangePolicy != "close" {
+		return sessions
+	}
+
+	log.Printf("Closing %d connections of port %s to previous master %s\n", len(sessions), p.port, oldMaster)
+
+	for _, s := range sessions {
+		s.local.Close()
+		s.remote.Close()
+	}
+
+	return sessions
+}
+
+// killStaleClients connects to the demoted master and kills connections made
+// by the proxy, so they are cut off on the Redis side even if closing them here
+// races with clients still writing
+func killStaleClients(ctx context.Context, master string, sessions []*session) {
+	var addrs []string
+	for _, s := range sessions {
+		if s.backendAddr != "" {
+			addrs = append(addrs, s.backendAddr)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.ProxyConnectionTimeout)*time.Second)
+	defer cancel()
+
+	conn, _, err := dialBackendAddr(ctx, master)
+	if err != nil {
+		log.Printf("Can't connect to previous master %s to kill stale clients: %s\n", master, err)
+		return
+	}
+
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	if config.Auth != "" {
+		writeCommand(w, "AUTH", config.Auth)
+	}
+	for _, addr := range addrs {
+		writeCommand(w, "CLIENT", "KILL", "ADDR", addr)
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Printf("Can't send CLIENT KILL to %s: %s\n", master, err)
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	if config.Auth != "" {
+		if _, err := readReply(r); err != nil && !isNoPassword(err) {
+			log.Printf("%s: AUTH failed: %s\n", master, err)
+			return
+		}
+	}
+
+	killed := 0
+	for range addrs {
+		reply, err := readReply(r)
+		if err != nil {
+			if _, ok := err.(redisError); !ok {
+				log.Printf("Can't read CLIENT KILL response from %s: %s\n", master, err)
+				return
+			}
+			continue // already gone
+		}
+
+		if n, err := strconv.Atoi(reply); err == nil {
+			killed += n
+		}
+	}
+
+	log.Printf("Killed %d of %d stale connections on previous master %s\n", killed, len(addrs), master)
+}
+
+// clientIP strips the port from the session's client address
+func (s *session) clientIP() string {
+	if host, _, err := net.SplitHostPort(s.client); err == nil {
+		return host
+	}
+
+	return s.client
+}
+
+func clientAddr(conn interface{}) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr().String()
+	}
+
+	return ""
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// setV6Only sets IPV6_V6ONLY on the socket
+func setV6Only(c syscall.RawConn, v6only bool) error {
+	value := 0
+	if v6only {
+		value = 1
+	}
+
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, value)
+	}); err != nil {
+		return err
+	}
+
+	return serr
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SSHTunnelConfig struct {
+	Host       string `yaml:"host"` // bastion host:port
+	User       string `yaml:"user"`
+	KeyFile    string `yaml:"key_file"`
+	KnownHosts string `yaml:"known_hosts"`
+}
+
+// sshDialer opens connections to Redis nodes as direct-tcpip channels
+// of a single shared SSH connection, reconnecting it when it breaks
+type sshDialer struct {
+	addr         string
+	clientConfig *ssh.ClientConfig
+
+	mutex  sync.Mutex
+	client *ssh.Client
+}
+
+func newSSHDialer(c SSHTunnelConfig) (*sshDialer, error) {
+	if c.Host == "" || c.User == "" || c.KeyFile == "" || c.KnownHosts == "" {
+		return nil, fmt.Errorf("host, user, key_file and known_hosts must be set")
+	}
+
+	addr := c.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	key, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %s", c.KeyFile, err)
+	}
+
+	hostKeyCallback, err := knownhosts.New(c.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshDialer{
+		addr: addr,
+		clientConfig: &ssh.ClientConfig{
+			User:            c.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// ssh.Client.Dial can't be cancelled, so leave it running in background
+	results := make(chan dialResult, 1)
+	go func() {
+		conn, err := client.Dial(network, addr)
+		results <- dialResult{conn, err}
+	}()
+
+	select {
+	case res := <-results:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-results; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (d *sshDialer) getClient(ctx context.Context) (*ssh.Client, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to SSH host %s: %s", d.addr, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %s", d.addr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	d.client = client
+
+	log.Printf("SSH tunnel to %s established\n", d.addr)
+
+	go d.keepAlive(client)
+
+	go func() {
+		err := client.Wait()
+
+		d.mutex.Lock()
+		if d.client == client {
+			d.client = nil
+		}
+		d.mutex.Unlock()
+
+		log.Printf("SSH tunnel to %s closed: %v\n", d.addr, err)
+	}()
+
+	return client, nil
+}
+
+// keepAlive closes the client if the server stops answering,
+// so that the next dial reconnects instead of hanging on a dead link
+func (d *sshDialer) keepAlive(client *ssh.Client) {
+	for {
+		time.Sleep(5 * time.Second)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errs <- err
+		}()
+
+		select {
+		case err := <-errs:
+			if err != nil {
+				client.Close()
+				return
+			}
+		case <-time.After(15 * time.Second):
+			log.Printf("SSH tunnel to %s doesn't respond to keepalives\n", d.addr)
+			client.Close()
+			return
+		}
+	}
+}
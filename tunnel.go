@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// serveTunnel accepts RESP tunneled over HTTP for clients that can only get out
+// through HTTP proxies: either "CONNECT <any host>:<port>" or a WebSocket
+// connection to /ws/<port>, binary frames carrying the raw RESP stream
+func serveTunnel(ctx context.Context, addr string) {
+	ws := websocket.Server{
+		Handshake: checkOrigin,
+		Handler:   func(conn *websocket.Conn) { handleWebSocket(conn) },
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodConnect:
+				handleConnect(w, r)
+			case strings.HasPrefix(r.URL.Path, "/ws/"):
+				ws.ServeHTTP(w, r)
+			default:
+				http.NotFound(w, r)
+			}
+		}),
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("Serving HTTP tunnel on %s\n", addr)
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Can't serve HTTP tunnel: %s\n", err)
+	}
+}
+
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "bad CONNECT target", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := redisPorts[port]
+	if !ok {
+		http.Error(w, "unknown port", http.StatusNotFound)
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Printf("Can't hijack CONNECT request: %s\n", err)
+		return
+	}
+
+	setKeepAlive(conn)
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	// the client may have sent some data right after the request
+	tc := &tunnelConn{ReadWriteCloser: conn, remote: conn.RemoteAddr(), done: make(chan struct{})}
+	if rw.Reader.Buffered() > 0 {
+		tc.ReadWriteCloser = &prefixedConn{conn, io.MultiReader(rw.Reader, conn)}
+	}
+
+	p.handleClient(tc)
+}
+
+// checkOrigin lets through non-browser clients, which don't send Origin, and pages
+// from tunnel_allowed_origins; otherwise any web page opened on an internal machine
+// could talk to Redis through the tunnel
+func checkOrigin(_ *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	for _, allowed := range config.TunnelAllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+func handleWebSocket(conn *websocket.Conn) {
+	p, ok := redisPorts[strings.TrimPrefix(conn.Request().URL.Path, "/ws/")]
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	conn.PayloadType = websocket.BinaryFrame
+
+	remote, _ := net.ResolveTCPAddr("tcp", conn.Request().RemoteAddr)
+	tc := &tunnelConn{ReadWriteCloser: conn, remote: remote, done: make(chan struct{})}
+
+	p.handleClient(tc)
+
+	// the connection is closed as soon as the handler returns
+	<-tc.done
+}
+
+// tunnelConn is a client connection carried over HTTP
+type tunnelConn struct {
+	io.ReadWriteCloser
+	remote net.Addr
+
+	once sync.Once
+	done chan struct{} // closed on Close
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}